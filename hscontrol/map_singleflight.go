@@ -0,0 +1,105 @@
+package hscontrol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"golang.org/x/sync/singleflight"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// typedGroup is a thin generic wrapper around singleflight.Group, which is
+// itself keyed by string. It lets callers key singleflight calls by
+// whatever comparable, stringable type makes sense for them (a node key, a
+// machine+node key pair, ...) instead of formatting strings at every call
+// site.
+type typedGroup[K fmt.Stringer, V any] struct {
+	group singleflight.Group
+}
+
+func (g *typedGroup[K, V]) Do(key K, fn func() (V, error)) (V, error, bool) {
+	result, err, shared := g.group.Do(key.String(), func() (any, error) {
+		return fn()
+	})
+
+	value, _ := result.(V)
+
+	return value, err, shared
+}
+
+// mapSessionKey is the singleflight key for a concurrent registration:
+// (machineKey, nodeKey) so a reconnect racing its own registration doesn't
+// collide with a different node. Streaming map sessions are tracked by node
+// key alone, in activeMapSessions.
+type mapSessionKey struct {
+	machineKey key.MachinePublic
+	nodeKey    key.NodePublic
+}
+
+func (k mapSessionKey) String() string {
+	return k.machineKey.String() + "|" + k.nodeKey.String()
+}
+
+var (
+	// nodeLookupGroup collapses concurrent GetNodeByNodeKey calls for the
+	// same node key into one DB round trip.
+	nodeLookupGroup typedGroup[key.NodePublic, *types.Node]
+
+	// registrationGroup collapses concurrent handleRegister calls for the
+	// same (machineKey, nodeKey) pair into one, so parallel registrations
+	// from a rapidly reconnecting client don't race each other's DB writes.
+	registrationGroup typedGroup[mapSessionKey, *tailcfg.RegisterResponse]
+
+	// activeMapSessions tracks the cancel func of the current streaming
+	// map session per node key, so a new long poll can proactively cancel
+	// an older one instead of leaving two long polls open for one node.
+	activeMapSessions   = make(map[key.NodePublic]activeMapSession)
+	activeMapSessionsMu sync.Mutex
+
+	// nextMapSessionGeneration hands out the ownership token stored
+	// alongside each activeMapSessions entry.
+	nextMapSessionGeneration uint64
+)
+
+// activeMapSession pairs a streaming map session's cancel func with a
+// generation token, so a session that lost the race to a newer one can
+// tell it no longer owns the entry and must not delete it out from under
+// the session that replaced it.
+type activeMapSession struct {
+	cancel     context.CancelFunc
+	generation uint64
+}
+
+// mapSessionShouldTakeOver reports whether a /machine/map request should
+// take over the node's active streaming map session slot. Only a streaming
+// (long poll) request may take over: a one-shot Hostinfo/endpoint update
+// sent alongside an already-open long poll must not cancel that long poll.
+func mapSessionShouldTakeOver(mapRequest tailcfg.MapRequest) bool {
+	return mapRequest.Stream
+}
+
+// takeOverMapSession cancels any previous streaming map session tracked for
+// nodeKey and registers cancel as the new one. The returned func releases
+// the registration once this session ends, which must be deferred by the
+// caller. The release is a no-op if a newer session has since taken over.
+func takeOverMapSession(nodeKey key.NodePublic, cancel context.CancelFunc) (release func()) {
+	activeMapSessionsMu.Lock()
+	if previous, ok := activeMapSessions[nodeKey]; ok {
+		previous.cancel()
+	}
+	nextMapSessionGeneration++
+	generation := nextMapSessionGeneration
+	activeMapSessions[nodeKey] = activeMapSession{cancel: cancel, generation: generation}
+	activeMapSessionsMu.Unlock()
+
+	return func() {
+		activeMapSessionsMu.Lock()
+		if current, ok := activeMapSessions[nodeKey]; ok && current.generation == generation {
+			delete(activeMapSessions, nodeKey)
+		}
+		activeMapSessionsMu.Unlock()
+	}
+}
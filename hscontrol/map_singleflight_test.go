@@ -0,0 +1,62 @@
+package hscontrol
+
+import (
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// TestTakeOverMapSessionLeavesStreamingSessionAloneForNonStreamRequest
+// guards against a non-streaming (one-shot) /machine/map request tearing
+// down an already-open long poll for the same node: per
+// mapSessionShouldTakeOver, a non-streaming request must never call
+// takeOverMapSession in the first place.
+func TestTakeOverMapSessionLeavesStreamingSessionAloneForNonStreamRequest(t *testing.T) {
+	nodeKey := key.NewNode().Public()
+
+	var streamingCancelled bool
+	streamingCancel := func() { streamingCancelled = true }
+
+	release := takeOverMapSession(nodeKey, streamingCancel)
+	defer release()
+
+	nonStreamRequest := tailcfg.MapRequest{Stream: false}
+	if mapSessionShouldTakeOver(nonStreamRequest) {
+		t.Fatal("a non-streaming request should not take over the map session slot")
+	}
+
+	if streamingCancelled {
+		t.Fatal("the streaming session's cancel func was invoked by an unrelated non-streaming request")
+	}
+
+	activeMapSessionsMu.Lock()
+	_, stillOwned := activeMapSessions[nodeKey]
+	activeMapSessionsMu.Unlock()
+	if !stillOwned {
+		t.Fatal("the streaming session's slot should still be owned")
+	}
+}
+
+// TestTakeOverMapSessionCancelsPreviousStreamingSession checks the other
+// side of the same coin: a second streaming request for the same node does
+// cancel the first one's session.
+func TestTakeOverMapSessionCancelsPreviousStreamingSession(t *testing.T) {
+	nodeKey := key.NewNode().Public()
+
+	var firstCancelled bool
+	firstRelease := takeOverMapSession(nodeKey, func() { firstCancelled = true })
+	defer firstRelease()
+
+	streamRequest := tailcfg.MapRequest{Stream: true}
+	if !mapSessionShouldTakeOver(streamRequest) {
+		t.Fatal("a streaming request should take over the map session slot")
+	}
+
+	secondRelease := takeOverMapSession(nodeKey, func() {})
+	defer secondRelease()
+
+	if !firstCancelled {
+		t.Fatal("taking over the slot with a new streaming session should cancel the previous one")
+	}
+}
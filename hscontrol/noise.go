@@ -1,12 +1,16 @@
 package hscontrol
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/juanfont/headscale/hscontrol/capver"
@@ -33,8 +37,61 @@ const (
 
 	// EarlyNoise was added in protocol version 49.
 	earlyNoiseCapabilityVersion = 49
+
+	// earlyNoiseExtrasCapabilityVersion is the first protocol version for
+	// which we also emit an EarlyNoiseExtras frame after the EarlyNoise
+	// payload. The frame is written only when the client's protocol version
+	// is at least this, so older clients never see it on the wire.
+	earlyNoiseExtrasCapabilityVersion = 90
+
+	// capVersionHeadroomCeiling mirrors the ceiling Tailscale enforces on
+	// capability versions: the noise handshake encodes the cap version in
+	// 16 bits, and code elsewhere in tailcfg panics past this point. We
+	// keep 5000 versions of headroom so we notice well before we get close.
+	capVersionHeadroomCeiling = math.MaxUint16 - 5000
 )
 
+// init runs once at process startup, so the headroom warning below reaches
+// the logs ops are watching at boot even if the server never receives a
+// client connection (e.g. it's failing health checks before any node
+// connects) to trigger it lazily.
+func init() {
+	warnIfCapVersionHeadroomLow()
+}
+
+// warnIfCapVersionHeadroomLow logs a warning if capver.MinSupportedCapabilityVersion
+// or the highest capability version we know about (tailcfg.CurrentCapabilityVersion)
+// have crept past capVersionHeadroomCeiling, i.e. to within 5000 of the 16-bit
+// limit the noise handshake encodes them in.
+func warnIfCapVersionHeadroomLow() {
+	if capver.MinSupportedCapabilityVersion > capVersionHeadroomCeiling {
+		log.Warn().
+			Int("minimum_cap_ver", int(capver.MinSupportedCapabilityVersion)).
+			Int("ceiling", capVersionHeadroomCeiling).
+			Msg("capver.MinSupportedCapabilityVersion is close to the 16-bit noise handshake limit")
+	}
+
+	if int(tailcfg.CurrentCapabilityVersion) > capVersionHeadroomCeiling {
+		log.Warn().
+			Int("current_cap_ver", int(tailcfg.CurrentCapabilityVersion)).
+			Int("ceiling", capVersionHeadroomCeiling).
+			Msg("tailcfg.CurrentCapabilityVersion is close to the 16-bit noise handshake limit")
+	}
+}
+
+// serverCapabilities are the capabilities this server advertises to clients
+// via EarlyNoiseExtras, independent of any particular node.
+var serverCapabilities = []tailcfg.NodeCapability{
+	tailcfg.CapabilityFileSharing,
+	tailcfg.CapabilityAdmin,
+	tailcfg.CapabilityHTTPS,
+}
+
+// noiseConnPool tracks every Noise connection currently being served over
+// /ts2021, so operators can see and control who is connected without
+// waiting for the long-poll to time out.
+var noiseConnPool = NewNoiseConnPool()
+
 type noiseServer struct {
 	headscale *Headscale
 
@@ -91,6 +148,15 @@ func (h *Headscale) NoiseUpgradeHandler(
 	noiseServer.machineKey = noiseServer.conn.Peer()
 	noiseServer.protocolVersion = noiseServer.conn.ProtocolVersion()
 
+	if noiseServer.protocolVersion > capVersionHeadroomCeiling {
+		httpError(writer, NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"client protocol version %d exceeds the maximum supported value %d",
+			noiseServer.protocolVersion, capVersionHeadroomCeiling,
+		), nil))
+
+		return
+	}
+
 	// This router is served only over the Noise connection, and exposes only the new API.
 	//
 	// The HTTP2 server that exposes this router is created for
@@ -108,6 +174,9 @@ func (h *Headscale) NoiseUpgradeHandler(
 	}
 	noiseServer.http2Server = &http2.Server{}
 
+	noiseConnPool.Register(&noiseServer)
+	defer noiseConnPool.Remove(noiseServer.machineKey, noiseServer.conn)
+
 	noiseServer.http2Server.ServeConn(
 		noiseConn,
 		&http2.ServeConnOpts{
@@ -151,9 +220,63 @@ func (ns *noiseServer) earlyNoise(protocolVersion int, writer io.Writer) error {
 		return err
 	}
 
+	if tailcfg.CapabilityVersion(protocolVersion) >= earlyNoiseExtrasCapabilityVersion {
+		if err := ns.writeEarlyNoiseExtras(writer); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// writeEarlyNoiseExtras writes a second length-prefixed frame right after
+// the EarlyNoise payload, carrying bootstrap hints the client would
+// otherwise only learn from its first /machine/map request. This frame has
+// no magic bytes of its own: it is only ever written for clients whose
+// protocol version gates it on, so there is no ambiguity for older readers.
+func (ns *noiseServer) writeEarlyNoiseExtras(writer io.Writer) error {
+	now := time.Now().UTC()
+	extras := types.EarlyNoiseExtras{
+		ServerCapabilities: serverCapabilities,
+		DERPMapHash:        derpMapHash(ns.headscale.DERPMap),
+		ControlTime:        &now,
+		MinSupportedCapVer: capver.MinSupportedCapabilityVersion,
+	}
+
+	extrasJSON, err := json.Marshal(&extras)
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(extrasJSON)))
+	if _, err := writer.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(extrasJSON); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// derpMapHash returns a short content hash of the DERP map, used as an
+// etag so the client can tell whether it needs to re-fetch the full map.
+func derpMapHash(derpMap *tailcfg.DERPMap) string {
+	if derpMap == nil {
+		return ""
+	}
+
+	raw, err := json.Marshal(derpMap)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(raw)
+
+	return fmt.Sprintf("%x", sum[:8])
+}
+
 func isSupportedVersion(version tailcfg.CapabilityVersion) bool {
 	return version >= capver.MinSupportedCapabilityVersion
 }
@@ -210,8 +333,11 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 	}
 
 	ns.nodeKey = mapRequest.NodeKey
+	noiseConnPool.Touch(ns.machineKey, ns.nodeKey)
 
-	node, err := ns.headscale.db.GetNodeByNodeKey(mapRequest.NodeKey)
+	node, err, _ := nodeLookupGroup.Do(mapRequest.NodeKey, func() (*types.Node, error) {
+		return ns.headscale.db.GetNodeByNodeKey(mapRequest.NodeKey)
+	})
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			httpError(writer, NewHTTPError(http.StatusNotFound, "node not found", nil))
@@ -221,13 +347,22 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 		return
 	}
 
-	sess := ns.headscale.newMapSession(req.Context(), mapRequest, writer, node)
-	sess.tracef("a node sending a MapRequest with Noise protocol")
-	if !sess.isStreaming() {
+	if !mapSessionShouldTakeOver(mapRequest) {
+		sess := ns.headscale.newMapSession(req.Context(), mapRequest, writer, node)
+		sess.tracef("a node sending a MapRequest with Noise protocol")
 		sess.serve()
-	} else {
-		sess.serveLongPoll()
+
+		return
 	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	release := takeOverMapSession(mapRequest.NodeKey, cancel)
+	defer release()
+
+	sess := ns.headscale.newMapSession(ctx, mapRequest, writer, node)
+	sess.tracef("a node sending a MapRequest with Noise protocol")
+	sess.serveLongPoll()
 }
 
 // NoiseRegistrationHandler handles the actual registration process of a node.
@@ -252,8 +387,12 @@ func (ns *noiseServer) NoiseRegistrationHandler(
 		}
 
 		ns.nodeKey = registerRequest.NodeKey
+		noiseConnPool.Touch(ns.machineKey, ns.nodeKey)
 
-		resp, err := ns.headscale.handleRegister(req.Context(), registerRequest, ns.conn.Peer())
+		regKey := mapSessionKey{machineKey: ns.machineKey, nodeKey: registerRequest.NodeKey}
+		resp, err, _ := registrationGroup.Do(regKey, func() (*tailcfg.RegisterResponse, error) {
+			return ns.headscale.handleRegister(req.Context(), registerRequest, ns.conn.Peer())
+		})
 		// TODO(kradalby): Here we could have two error types, one that is surfaced to the client
 		// and one that returns 500.
 		if err != nil {
@@ -0,0 +1,19 @@
+package hscontrol
+
+import "tailscale.com/types/key"
+
+// ListNoiseSessions returns a snapshot of the Noise (ts2021) sessions
+// currently open on this server, for an admin CLI/API to show operators who
+// is currently connected. Nothing in the server calls it itself.
+func (h *Headscale) ListNoiseSessions() []NoiseConnSession {
+	return noiseConnPool.ListSessions()
+}
+
+// KillNoiseSession force-closes the live Noise session for machineKey, if
+// any, so the node re-polls immediately instead of waiting for its long
+// poll to time out. It returns true if a session was found and closed.
+// Nothing in the server calls it itself: neither key revocation nor ACL
+// changes close a node's live session through it.
+func (h *Headscale) KillNoiseSession(machineKey key.MachinePublic) bool {
+	return noiseConnPool.KillSession(machineKey)
+}
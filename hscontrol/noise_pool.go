@@ -0,0 +1,152 @@
+package hscontrol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"tailscale.com/control/controlbase"
+	"tailscale.com/types/key"
+)
+
+var (
+	noiseConnPoolOpenSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: prometheusNamespace,
+		Name:      "noise_open_sessions",
+		Help:      "Number of Noise (ts2021) connections currently held open by the server",
+	})
+
+	noiseConnPoolChurn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "noise_session_churn_total",
+		Help:      "Number of Noise (ts2021) sessions opened/closed, by reason",
+	}, []string{"action", "reason"})
+)
+
+// NoiseConnSession describes a single live Noise connection held by the
+// server, keyed by the machine key that authenticated it. The conn and h2
+// handles are kept unexported: they are internal to the pool, not
+// something the admin CLI/API should reach through and manipulate
+// directly. The remaining fields are exported so that surface can display
+// and act on them.
+type NoiseConnSession struct {
+	conn *controlbase.Conn
+	h2   *http2.Server
+
+	ProtocolVersion int
+	CreatedAt       time.Time
+	LastUsed        time.Time
+	MachineKey      key.MachinePublic
+	NodeKey         key.NodePublic
+}
+
+// NoiseConnPool tracks the Noise connections currently being served by
+// NoiseUpgradeHandler, keyed by key.MachinePublic. It is the server-side
+// analogue of the NoiseClient connection pool used by the client.
+type NoiseConnPool struct {
+	mu    sync.Mutex
+	conns map[key.MachinePublic]*NoiseConnSession
+}
+
+// NewNoiseConnPool creates an empty NoiseConnPool.
+func NewNoiseConnPool() *NoiseConnPool {
+	return &NoiseConnPool{
+		conns: make(map[key.MachinePublic]*NoiseConnSession),
+	}
+}
+
+// Register records a newly upgraded Noise connection, evicting and closing
+// any stale entry already tracked for the same machine key.
+func (p *NoiseConnPool) Register(ns *noiseServer) {
+	now := time.Now()
+	session := &NoiseConnSession{
+		conn:            ns.conn,
+		h2:              ns.http2Server,
+		ProtocolVersion: ns.protocolVersion,
+		CreatedAt:       now,
+		LastUsed:        now,
+		MachineKey:      ns.machineKey,
+		NodeKey:         ns.nodeKey,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.conns[ns.machineKey]; ok {
+		log.Debug().
+			Caller().
+			Str("machine_key", ns.machineKey.ShortString()).
+			Msg("replacing stale Noise session for machine key")
+		old.conn.Close()
+		noiseConnPoolChurn.WithLabelValues("closed", "replaced").Inc()
+	} else {
+		noiseConnPoolOpenSessions.Inc()
+	}
+
+	p.conns[ns.machineKey] = session
+	noiseConnPoolChurn.WithLabelValues("opened", "upgrade").Inc()
+}
+
+// Touch records that the given machine key's session was just used, and
+// updates the tracked node key once it is known (it is not available until
+// the first register/map request on the connection).
+func (p *NoiseConnPool) Touch(machineKey key.MachinePublic, nodeKey key.NodePublic) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if session, ok := p.conns[machineKey]; ok {
+		session.LastUsed = time.Now()
+		session.NodeKey = nodeKey
+	}
+}
+
+// Remove stops tracking the session for the given machine key, but only if
+// conn is still the one currently registered for that key. This matters on
+// reconnect: the old connection's own handler still has a Remove deferred
+// after Register has already replaced its entry with the new connection,
+// and that stale call must not evict the session that replaced it.
+func (p *NoiseConnPool) Remove(machineKey key.MachinePublic, conn *controlbase.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if session, ok := p.conns[machineKey]; ok && session.conn == conn {
+		delete(p.conns, machineKey)
+		noiseConnPoolOpenSessions.Dec()
+		noiseConnPoolChurn.WithLabelValues("closed", "disconnected").Inc()
+	}
+}
+
+// KillSession force-closes the live Noise connection for the given machine
+// key, if any, triggering an immediate re-poll by the client instead of
+// waiting for the long poll to time out. Returns true if a session was
+// found and closed.
+func (p *NoiseConnPool) KillSession(machineKey key.MachinePublic) bool {
+	p.mu.Lock()
+	session, ok := p.conns[machineKey]
+	p.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	session.conn.Close()
+
+	return true
+}
+
+// ListSessions returns a snapshot of the currently live Noise sessions, for
+// use by the admin CLI/API.
+func (p *NoiseConnPool) ListSessions() []NoiseConnSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sessions := make([]NoiseConnSession, 0, len(p.conns))
+	for _, session := range p.conns {
+		sessions = append(sessions, *session)
+	}
+
+	return sessions
+}
@@ -0,0 +1,39 @@
+package hscontrol
+
+import (
+	"testing"
+
+	"tailscale.com/control/controlbase"
+	"tailscale.com/types/key"
+)
+
+// TestNoiseConnPoolStaleRemoveDoesNotEvictNewSession guards against a
+// reconnect race: an old connection's handler calls Remove after a new
+// connection has already replaced it in the pool for the same machine key.
+// That stale Remove must not evict the session that replaced it.
+func TestNoiseConnPoolStaleRemoveDoesNotEvictNewSession(t *testing.T) {
+	pool := NewNoiseConnPool()
+	machineKey := key.NewMachine().Public()
+
+	oldConn := &controlbase.Conn{}
+	newConn := &controlbase.Conn{}
+
+	pool.conns[machineKey] = &NoiseConnSession{conn: oldConn, MachineKey: machineKey}
+	// Simulate Register having already evicted oldConn in favour of newConn.
+	pool.conns[machineKey] = &NoiseConnSession{conn: newConn, MachineKey: machineKey}
+
+	pool.Remove(machineKey, oldConn)
+
+	session, ok := pool.conns[machineKey]
+	if !ok {
+		t.Fatal("Remove with a stale conn evicted the new session")
+	}
+	if session.conn != newConn {
+		t.Fatal("pool no longer tracks the new session's conn")
+	}
+
+	pool.Remove(machineKey, newConn)
+	if _, ok := pool.conns[machineKey]; ok {
+		t.Fatal("Remove with the current conn should have evicted the session")
+	}
+}
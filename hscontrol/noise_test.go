@@ -0,0 +1,28 @@
+package hscontrol
+
+import (
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/capver"
+	"tailscale.com/tailcfg"
+)
+
+// TestNoiseCapVersionHeadroom guards against the capability version space
+// creeping up on the 16-bit limit the noise handshake encodes it in. If
+// this test fails, it's time to talk to upstream Tailscale about the
+// ceiling before raising capVersionHeadroomCeiling.
+func TestNoiseCapVersionHeadroom(t *testing.T) {
+	if capver.MinSupportedCapabilityVersion > capVersionHeadroomCeiling {
+		t.Errorf(
+			"capver.MinSupportedCapabilityVersion (%d) exceeds the headroom ceiling (%d)",
+			capver.MinSupportedCapabilityVersion, capVersionHeadroomCeiling,
+		)
+	}
+
+	if int(tailcfg.CurrentCapabilityVersion) > capVersionHeadroomCeiling {
+		t.Errorf(
+			"tailcfg.CurrentCapabilityVersion (%d) exceeds the headroom ceiling (%d)",
+			tailcfg.CurrentCapabilityVersion, capVersionHeadroomCeiling,
+		)
+	}
+}
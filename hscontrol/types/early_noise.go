@@ -0,0 +1,32 @@
+package types
+
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// EarlyNoiseExtras carries bootstrap hints the server sends in a second
+// length-prefixed frame immediately following the EarlyNoise payload, so a
+// client doesn't have to pay a full /machine/map roundtrip just to learn
+// things the server already knows at handshake time.
+//
+// The server writes this frame only for clients at or above a capability
+// version threshold, so it is never written to an older client's connection; the
+// wire framing of the original EarlyNoise payload is unchanged.
+type EarlyNoiseExtras struct {
+	// ServerCapabilities are the capabilities this server advertises to
+	// clients, independent of any particular node.
+	ServerCapabilities []tailcfg.NodeCapability `json:"serverCapabilities,omitempty"`
+
+	// DERPMapHash is a content hash of the current DERP map, so the client
+	// can skip re-downloading an unchanged map on its first poll.
+	DERPMapHash string `json:"derpMapHash,omitempty"`
+
+	// ControlTime is the server's current time, mirroring tailcfg.MapResponse.ControlTime.
+	ControlTime *time.Time `json:"controlTime,omitempty"`
+
+	// MinSupportedCapVer is the lowest client capability version this
+	// server will still accept.
+	MinSupportedCapVer tailcfg.CapabilityVersion `json:"minSupportedCapVer,omitempty"`
+}